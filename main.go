@@ -6,42 +6,85 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/btcsuite/btcutil/base58"
+	"github.com/fsnotify/fsnotify"
 	"github.com/gabriel-vasile/mimetype"
 	"golang.org/x/net/html"
 	"io"
 	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 func main() {
 	public, data := "../../playbymail.net", ""
+	wayback, waybackTimestamp, waybackCache := false, "", true
+	cas := false
+	workers := runtime.NumCPU()
+	watch := false
+	rewriters := ""
 	flag.StringVar(&data, "data", data, "location of data files")
 	flag.StringVar(&public, "public", public, "location of public files")
+	flag.BoolVar(&wayback, "wayback", wayback, "fetch missing files from the Wayback Machine")
+	flag.StringVar(&waybackTimestamp, "wayback-timestamp", waybackTimestamp, "preferred snapshot timestamp (YYYYMMDDhhmmss) for Wayback fallback")
+	flag.BoolVar(&waybackCache, "wayback-cache", waybackCache, "cache Wayback Machine fallback responses under the public directory")
+	flag.BoolVar(&cas, "cas", cas, "rewrite link/script/img URLs to content-addressed /.cas/ form with SRI integrity attributes")
+	flag.IntVar(&workers, "workers", workers, "number of concurrent workers used to hash the public tree")
+	flag.BoolVar(&watch, "watch", watch, "watch the public directory and update the cache as files change")
+	flag.StringVar(&rewriters, "rewriters", rewriters, "path to a JSON config of additional regexp-based URL rewrite rules")
 	flag.Parse()
 
 	started := time.Now()
-	err := run(public, data)
+	err := run(public, data, wayback, waybackTimestamp, waybackCache, cas, workers, watch, rewriters)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("completed in %v\n", time.Now().Sub(started))
 }
 
-func run(site, data string) error {
+func run(site, data string, wayback bool, waybackTimestamp string, waybackCache bool, cas bool, workers int, watch bool, rewritersPath string) error {
 	var err error
+	pfx := []string{"http://playbymail.net/", "https://playbymail.net/"}
 	s := &server{
-		files: make(map[string]*fileinfo_t),
-		pfx:   []string{"http://playbymail.net/", "https://playbymail.net/"},
+		files:             make(map[string]*fileinfo_t),
+		pfx:               pfx,
+		rewriters:         []Rewriter{prefixRewriter{prefixes: pfx}},
+		wayback:           wayback,
+		waybackTimestamp:  waybackTimestamp,
+		waybackCache:      waybackCache,
+		waybackAPI:        "https://archive.org/wayback/available",
+		cas:               cas,
+		workers:           workers,
+		watch:             watch,
+	}
+	if wayback {
+		s.rewriters = append(s.rewriters, waybackRewriter{})
+	}
+	if rewritersPath != "" {
+		rw, err := loadRewriters(rewritersPath)
+		if err != nil {
+			return err
+		}
+		s.rewriters = append(s.rewriters, rw)
 	}
 	s.public, err = filepath.Abs(site)
 	if err != nil {
@@ -51,12 +94,30 @@ func run(site, data string) error {
 	if err != nil {
 		return err
 	}
+	if data == "" {
+		// no -data directory, so no manifest (filepath.Abs("") is the working directory)
+		s.data = ""
+	}
+	s.publicFS, err = openPublic(s.public)
+	if err != nil {
+		return err
+	}
 
 	err = s.cacheFiles()
 	if err != nil {
 		return err
 	}
 
+	if s.watch {
+		_, isArchive := s.publicFS.(*zip.ReadCloser)
+		_, isMemFS := s.publicFS.(memFS)
+		if isArchive || isMemFS {
+			log.Printf("watch: ignoring -watch for archive-backed public tree %q\n", s.public)
+		} else if err := s.startWatch(); err != nil {
+			return err
+		}
+	}
+
 	if data != "" {
 		bb, kinds, sums := &bytes.Buffer{}, make(map[string]bool), make(map[string][]string)
 		for _, fi := range s.files {
@@ -101,50 +162,322 @@ func run(site, data string) error {
 	}
 
 	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/.cas/", s.handleCAS)
 	s.mux.HandleFunc("/", s.handleGet)
 
-	err = os.Chdir(s.public)
-	if err != nil {
-		return err
-	}
-	pwd, err := os.Getwd()
-	if err != nil {
-		return err
+	if s.watch {
+		_, isArchive := s.publicFS.(*zip.ReadCloser)
+		_, isMemFS := s.publicFS.(memFS)
+		if isArchive || isMemFS {
+			log.Printf("watch: ignoring -watch for archive-backed public tree %q\n", s.public)
+		} else if err := s.startWatch(); err != nil {
+			return err
+		}
 	}
-	log.Printf("working directory now %q\n", pwd)
+
+	log.Printf("serving from %q\n", s.public)
 
 	return http.ListenAndServe(":8080", s.mux)
 }
 
 type fileinfo_t struct {
-	name  string
-	cksum string
-	kind  string
-	mod   time.Time
+	name   string
+	cksum  string // base58-encoded sha1, used in CAS URLs
+	sum    []byte // raw sha1, used for content addressing
+	sum256 []byte // raw sha256, used for SRI integrity attributes
+	kind   string
+	mod    time.Time
+	size   int64
 }
 
 type server struct {
-	files  map[string]*fileinfo_t
-	mux    *http.ServeMux
-	public string
-	data   string
-	pfx    []string
+	files     map[string]*fileinfo_t
+	mux       *http.ServeMux
+	public    string
+	publicFS  fs.FS // the public tree: a directory, a zip, or a tar.gz bundle
+	data      string
+	pfx       []string
+	rewriters []Rewriter // applied in order by rewriteURL; see prefixRewriter etc.
+
+	wayback          bool              // fetch missing files from the Wayback Machine
+	waybackTimestamp string            // preferred snapshot timestamp, YYYYMMDDhhmmss
+	waybackCache     bool              // persist fetched snapshots under s.public
+	waybackAPI       string            // base URL for the "available" lookup API
+	blobs            map[string][]byte // uncached wayback fetches, keyed by rpath
+
+	cas   bool                   // rewrite link/script/img URLs to content-addressed form
+	bySum map[string]*fileinfo_t // reverse lookup by cksum, for the /.cas/ route
+
+	workers int          // number of concurrent cacheFiles workers
+	mu      sync.RWMutex // guards files, bySum, and blobs
+
+	watch   bool              // watch s.public and update files/bySum incrementally
+	watcher *fsnotify.Watcher // nil unless watch is enabled
 }
 
-func (s *server) cacheFiles() error {
-	err := os.Chdir(s.public)
+// waybackAvailable is the subset of the Wayback Machine "available" API
+// response that we care about.
+type waybackAvailable struct {
+	ArchivedSnapshots struct {
+		Closest struct {
+			Available bool   `json:"available"`
+			URL       string `json:"url"`
+			Timestamp string `json:"timestamp"`
+			Status    string `json:"status"`
+		} `json:"closest"`
+	} `json:"archived_snapshots"`
+}
+
+// memFS is a minimal in-memory fs.FS for serving an archive (tar.gz) whose
+// format doesn't already provide one the way archive/zip does. Directories
+// are synthesized from the file paths put into it.
+type memFS map[string]*memFile
+
+type memFile struct {
+	name string
+	data []byte
+	mod  time.Time
+	dir  bool
+}
+
+func (f *memFile) Name() string       { return path.Base(f.name) }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) ModTime() time.Time { return f.mod }
+func (f *memFile) IsDir() bool        { return f.dir }
+func (f *memFile) Sys() any           { return nil }
+func (f *memFile) Type() fs.FileMode  { return f.Mode().Type() }
+func (f *memFile) Info() (fs.FileInfo, error) {
+	return f, nil
+}
+func (f *memFile) Mode() fs.FileMode {
+	if f.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// put registers a file and synthesizes any missing parent directories.
+func (m memFS) put(name string, data []byte, mod time.Time) {
+	m[name] = &memFile{name: name, data: data, mod: mod}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, ok := m[dir]; ok {
+			continue
+		}
+		m[dir] = &memFile{name: dir, mod: mod, dir: true}
+	}
+}
+
+func (m memFS) Open(name string) (fs.File, error) {
+	if name == "." {
+		return &memOpenFile{memFile: &memFile{name: ".", dir: true}, fs: m}, nil
+	}
+	f, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memOpenFile{memFile: f, fs: m, Reader: bytes.NewReader(f.data)}, nil
+}
+
+func (m memFS) ReadFile(name string) ([]byte, error) {
+	f, ok := m[name]
+	if !ok || f.dir {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.data, nil
+}
+
+func (m memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		if f, ok := m[name]; !ok || !f.dir {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	var entries []fs.DirEntry
+	for p, f := range m {
+		if path.Dir(p) == name {
+			entries = append(entries, f)
+		}
+	}
+	return entries, nil
+}
+
+// memOpenFile is the fs.File/fs.ReadDirFile handle returned by memFS.Open.
+type memOpenFile struct {
+	*memFile
+	fs memFS
+	*bytes.Reader
+}
+
+func (f *memOpenFile) Stat() (fs.FileInfo, error) { return f.memFile, nil }
+func (f *memOpenFile) Close() error               { return nil }
+func (f *memOpenFile) Read(p []byte) (int, error) {
+	if f.Reader == nil {
+		return 0, io.EOF
+	}
+	return f.Reader.Read(p)
+}
+func (f *memOpenFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := f.fs.ReadDir(f.name)
+	if err != nil || n <= 0 {
+		return entries, err
+	}
+	if n > len(entries) {
+		n = len(entries)
+	}
+	return entries[:n], nil
+}
+
+// manifestEntry is one row of the on-disk b58.manifest.json cache: enough
+// to tell, on the next run, whether a file needs to be re-hashed.
+type manifestEntry struct {
+	Cksum     string    `json:"cksum"`
+	RawSum    string    `json:"rawsum"`    // base64-encoded raw sha1
+	RawSum256 string    `json:"rawsum256"` // base64-encoded raw sha256
+	ModTime   time.Time `json:"mtime"`
+	Size      int64     `json:"size"`
+	Kind      string    `json:"kind"`
+}
+
+// manifestPath returns where the hash manifest is cached, or "" if there's
+// nowhere to put one (no -data directory was given).
+func (s *server) manifestPath() string {
+	if s.data == "" {
+		return ""
+	}
+	return filepath.Join(s.data, "b58.manifest.json")
+}
+
+func (s *server) loadManifest() map[string]manifestEntry {
+	manifest := make(map[string]manifestEntry)
+	p := s.manifestPath()
+	if p == "" {
+		return manifest
+	}
+	raw, err := os.ReadFile(p)
 	if err != nil {
-		return err
+		return manifest
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		log.Printf("%s: %v\n", p, err)
+		return make(map[string]manifestEntry)
 	}
-	pwd, err := os.Getwd()
+	return manifest
+}
+
+func (s *server) saveManifest() {
+	p := s.manifestPath()
+	if p == "" {
+		return
+	}
+	manifest := make(map[string]manifestEntry, len(s.files))
+	for _, fi := range s.files {
+		manifest[fi.name] = manifestEntry{
+			Cksum:     fi.cksum,
+			RawSum:    base64.StdEncoding.EncodeToString(fi.sum),
+			RawSum256: base64.StdEncoding.EncodeToString(fi.sum256),
+			ModTime:   fi.mod,
+			Size:      fi.size,
+			Kind:      fi.kind,
+		}
+	}
+	raw, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
-		return err
+		log.Printf("manifest: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(p, raw, 0644); err != nil {
+		log.Printf("%s: %v\n", p, err)
+	}
+}
+
+// hashFile computes the fileinfo_t for name, reusing the manifest entry
+// (if any) when the file's size and mtime haven't changed.
+func (s *server) hashFile(name string, info fs.FileInfo, manifest map[string]manifestEntry) (*fileinfo_t, error) {
+	if entry, ok := manifest[name]; ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		sum, err := base64.StdEncoding.DecodeString(entry.RawSum)
+		sum256, err256 := base64.StdEncoding.DecodeString(entry.RawSum256)
+		if err == nil && err256 == nil {
+			return &fileinfo_t{name: name, cksum: entry.Cksum, sum: sum, sum256: sum256, mod: info.ModTime(), size: entry.Size, kind: entry.Kind}, nil
+		}
 	}
-	log.Printf("working directory now %q\n", pwd)
 
+	fp, err := s.publicFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	head := make([]byte, 3072)
+	n, err := io.ReadFull(fp, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	h, h256 := sha1.New(), sha256.New()
+	mw := io.MultiWriter(h, h256)
+	mw.Write(head)
+	if _, err := io.Copy(mw, fp); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+
+	return &fileinfo_t{
+		name:   name,
+		cksum:  string(base58.Encode(sum)),
+		sum:    sum,
+		sum256: h256.Sum(nil),
+		mod:    info.ModTime(),
+		size:   info.Size(),
+		kind:   filetype(name, head),
+	}, nil
+}
+
+// cacheFiles walks s.publicFS and hashes every file, using a pool of
+// s.workers goroutines so a large tree doesn't serialize on disk I/O.
+// fs.WalkDir only enqueues paths; the workers do the hashing and
+// fill in s.files behind s.mu. Files whose size and mtime match the
+// on-disk manifest are reused rather than re-hashed.
+func (s *server) cacheFiles() error {
+	manifest := s.loadManifest()
+
+	s.mu.Lock()
 	s.files = make(map[string]*fileinfo_t)
+	s.mu.Unlock()
+
+	workers := s.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	type job struct {
+		path string
+		info fs.FileInfo
+	}
+	jobs := make(chan job, workers*2)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				fi, err := s.hashFile(j.path, j.info, manifest)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					continue
+				}
+				s.mu.Lock()
+				s.files[fi.name] = fi
+				s.mu.Unlock()
+			}
+		}()
+	}
 
-	err = filepath.WalkDir(".", func(path string, file fs.DirEntry, err error) error {
+	walkErr := fs.WalkDir(s.publicFS, ".", func(name string, file fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		} else if file.IsDir() {
@@ -154,20 +487,366 @@ func (s *server) cacheFiles() error {
 			if err != nil {
 				return err
 			}
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return err
+			jobs <- job{path: name, info: info}
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+
+	if walkErr != nil {
+		return walkErr
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	s.mu.Lock()
+	s.bySum = make(map[string]*fileinfo_t, len(s.files))
+	for _, fi := range s.files {
+		s.bySum[fi.cksum] = fi
+	}
+	s.mu.Unlock()
+
+	s.saveManifest()
+
+	return nil
+}
+
+// lookupFile returns the cached fileinfo_t for rpath, if any, under s.mu.
+func (s *server) lookupFile(rpath string) (*fileinfo_t, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fi, ok := s.files[rpath]
+	return fi, ok
+}
+
+// lookupBySum returns the cached fileinfo_t for a CAS digest, if any, under
+// s.mu.
+func (s *server) lookupBySum(cksum string) (*fileinfo_t, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fi, ok := s.bySum[cksum]
+	return fi, ok
+}
+
+// lookupBlob returns the uncached wayback bytes for rpath, if any, under
+// s.mu.
+func (s *server) lookupBlob(rpath string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blob, ok := s.blobs[rpath]
+	return blob, ok
+}
+
+// storeBlob records the uncached wayback bytes for rpath under s.mu.
+func (s *server) storeBlob(rpath string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobs == nil {
+		s.blobs = make(map[string][]byte)
+	}
+	s.blobs[rpath] = data
+}
+
+// startWatch subscribes to filesystem events under s.public so that edits
+// made while the server is running are picked up without a restart. Only
+// directory-backed public trees are supported; callers must not invoke this
+// for a zip or tar.gz-backed s.publicFS.
+func (s *server) startWatch() error {
+	if s.watcher != nil {
+		return nil // already watching
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir(s.public, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return w.Add(p)
+		}
+		return nil
+	})
+	if err != nil {
+		w.Close()
+		return err
+	}
+	s.watcher = w
+	go s.watchLoop()
+	log.Printf("watch: watching %q for changes\n", s.public)
+	return nil
+}
+
+// watchLoop drains fsnotify events until the watcher is closed.
+func (s *server) watchLoop() {
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			s.handleWatchEvent(event)
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
 			}
-			h := sha1.New()
-			h.Write(data)
-			encoded := base58.Encode(h.Sum(nil))
-			fi := &fileinfo_t{name: path, cksum: string(encoded), mod: info.ModTime(), kind: filetype(path, data)}
-			s.files[fi.name] = fi
+			log.Printf("watch: %v\n", err)
 		}
+	}
+}
+
+// handleWatchEvent applies a single fsnotify event to s.files/s.bySum.
+func (s *server) handleWatchEvent(event fsnotify.Event) {
+	rel, err := filepath.Rel(s.public, event.Name)
+	if err != nil {
+		return
+	}
+	rpath := filepath.ToSlash(rel)
+
+	switch {
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		s.forgetFile(rpath)
+	case event.Op&fsnotify.Create != 0:
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			s.watchNewDir(event.Name)
+			return
+		}
+		s.refreshFile(rpath)
+	case event.Op&fsnotify.Write != 0:
+		s.refreshFile(rpath)
+	}
+}
+
+// watchNewDir subscribes to a directory that just appeared under s.public
+// and walks it to hash any files fsnotify's own per-file Create events
+// might race with (there's no guarantee those arrive before or after the
+// watch registers), so files already present in the new subtree don't sit
+// invisible to s.files until a restart.
+func (s *server) watchNewDir(dir string) {
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return s.watcher.Add(p)
+		}
+		rel, err := filepath.Rel(s.public, p)
+		if err != nil {
+			return nil
+		}
+		s.refreshFile(filepath.ToSlash(rel))
 		return nil
 	})
+	if err != nil {
+		log.Printf("watch: %s: %v\n", dir, err)
+	}
+}
 
-	return err
+// forgetFile removes rpath (and, since the rendered HTML for any page is
+// produced fresh per request by clean, there is no separate rewrite cache to
+// invalidate) from s.files/s.bySum.
+func (s *server) forgetFile(rpath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fi, ok := s.files[rpath]; ok {
+		delete(s.bySum, fi.cksum)
+	}
+	delete(s.files, rpath)
+	log.Printf("watch: removed %s\n", rpath)
+}
+
+// refreshFile re-hashes rpath and updates s.files/s.bySum in place.
+func (s *server) refreshFile(rpath string) {
+	info, err := os.Stat(filepath.Join(s.public, filepath.FromSlash(rpath)))
+	if err != nil {
+		log.Printf("watch: %s: %v\n", rpath, err)
+		return
+	}
+	fi, err := s.hashFile(rpath, info, nil)
+	if err != nil {
+		log.Printf("watch: %s: %v\n", rpath, err)
+		return
+	}
+	s.mu.Lock()
+	if old, ok := s.files[rpath]; ok {
+		delete(s.bySum, old.cksum)
+	}
+	s.files[rpath] = fi
+	s.bySum[fi.cksum] = fi
+	s.mu.Unlock()
+	log.Printf("watch: updated %s\n", rpath)
+}
+
+// openPublic opens the public tree rooted at p as an fs.FS, sniffing the
+// extension to decide whether p is a directory, a zip archive, or a
+// tar.gz/tgz bundle.
+func openPublic(p string) (fs.FS, error) {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".zip":
+		zr, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	case ".tgz":
+		return openTarGz(p)
+	case ".gz":
+		if strings.HasSuffix(strings.ToLower(p), ".tar.gz") {
+			return openTarGz(p)
+		}
+	}
+	return os.DirFS(p), nil
+}
+
+// openTarGz reads a tar.gz bundle fully into memory and returns an fs.FS
+// backed by it. Archives are assumed small enough for a static site.
+func openTarGz(p string) (fs.FS, error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	mfs := make(memFS)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if hdr.Typeflag == tar.TypeDir || name == "." {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		mfs.put(name, data, hdr.ModTime)
+	}
+	return mfs, nil
+}
+
+// fetchFromWayback looks up the closest Wayback Machine snapshot for rpath,
+// fetches it, caches it under s.public (when s.waybackCache is set and
+// s.public is a directory rather than a zip or tar.gz bundle), and
+// registers it in s.files the same way cacheFiles does for originals.
+func (s *server) fetchFromWayback(rpath string) (*fileinfo_t, error) {
+	origin := s.pfx[0] + rpath
+
+	lookup := s.waybackAPI + "?" + url.Values{
+		"url":       {origin},
+		"timestamp": {s.waybackTimestamp},
+	}.Encode()
+	resp, err := http.Get(lookup)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var avail waybackAvailable
+	if err := json.NewDecoder(resp.Body).Decode(&avail); err != nil {
+		return nil, err
+	}
+	closest := avail.ArchivedSnapshots.Closest
+	if !closest.Available || closest.URL == "" {
+		return nil, fmt.Errorf("%s: no wayback snapshot available", origin)
+	}
+
+	snap, err := http.Get(closest.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Body.Close()
+	if snap.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: wayback snapshot returned %s", closest.URL, snap.Status)
+	}
+	data, err := io.ReadAll(snap.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	_, isArchive := s.publicFS.(*zip.ReadCloser)
+	_, isMemFS := s.publicFS.(memFS)
+	if s.waybackCache && !isArchive && !isMemFS {
+		dst := filepath.Join(s.public, filepath.FromSlash(rpath))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(dst, data, 0644); err != nil {
+			return nil, err
+		}
+	} else {
+		// not persisted to s.public, so keep the bytes around to serve
+		// this and future requests for rpath until the process restarts.
+		s.storeBlob(rpath, data)
+	}
+
+	h := sha1.New()
+	h.Write(data)
+	sum := h.Sum(nil)
+	sum256 := sha256.Sum256(data)
+	fi := &fileinfo_t{
+		name:   rpath,
+		cksum:  string(base58.Encode(sum)),
+		sum:    sum,
+		sum256: sum256[:],
+		mod:    time.Now(),
+		size:   int64(len(data)),
+		kind:   filetype(rpath, data),
+	}
+	s.mu.Lock()
+	s.files[fi.name] = fi
+	if s.bySum == nil {
+		s.bySum = make(map[string]*fileinfo_t)
+	}
+	s.bySum[fi.cksum] = fi
+	s.mu.Unlock()
+	log.Printf("wayback %s: fetched snapshot %s\n", rpath, closest.Timestamp)
+	return fi, nil
+}
+
+// handleCAS serves a cached file by its content digest. Since the digest
+// changes whenever the content does, the response can be cached forever.
+func (s *server) handleCAS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	sum := strings.TrimPrefix(r.URL.Path, "/.cas/")
+	file, ok := s.lookupBySum(sum)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Add("Content-Type", file.kind)
+
+	if blob, cached := s.lookupBlob(file.name); cached {
+		http.ServeContent(w, r, file.name, file.mod, bytes.NewReader(blob))
+		return
+	}
+	data, err := fs.ReadFile(s.publicFS, file.name)
+	if err != nil {
+		log.Printf("%s not found\n", file.name)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	http.ServeContent(w, r, file.name, file.mod, bytes.NewReader(data))
 }
 
 func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
@@ -177,21 +856,29 @@ func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
 	}
 	//log.Printf("%s %s\n", r.Method, r.URL)
 	rpath := strings.TrimSuffix(strings.TrimPrefix(r.URL.String(), "/"), "/")
-	file, ok := s.files[rpath]
+	file, ok := s.lookupFile(rpath)
 	if !ok {
 		// try with commas and pipes
 		cpath := strings.Replace(rpath, "%2C", ",", -1)
 		cpath = strings.Replace(cpath, "%7C", "|", -1)
-		file, ok = s.files[cpath]
+		file, ok = s.lookupFile(cpath)
 	}
 	if !ok {
 		// try with index.html
-		if file, ok = s.files[rpath+"/index.html"]; ok {
+		if file, ok = s.lookupFile(rpath + "/index.html"); ok {
 			//log.Printf("%s %s: redirect %s %s\n", r.Method, r.URL, rpath, "index.html")
 			http.Redirect(w, r, "/"+rpath+"/index.html", http.StatusFound)
 			return
 		}
 	}
+	if !ok && s.wayback {
+		var fetchErr error
+		file, fetchErr = s.fetchFromWayback(rpath)
+		ok = fetchErr == nil
+		if fetchErr != nil {
+			log.Printf("%s %s: wayback fallback: %v\n", r.Method, rpath, fetchErr)
+		}
+	}
 	if !ok {
 		log.Printf("%s %s not found\n", r.Method, rpath)
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
@@ -199,16 +886,21 @@ func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
 	}
 	//log.Printf("%s %s: %s\n", r.Method, r.URL, file.kind)
 
+	if blob, cached := s.lookupBlob(file.name); cached {
+		w.Header().Add("Content-Type", file.kind)
+		http.ServeContent(w, r, file.name, file.mod, bytes.NewReader(blob))
+		return
+	}
+
 	if !strings.HasPrefix(file.kind, "text/html") {
-		fp, err := os.Open(file.name)
+		data, err := fs.ReadFile(s.publicFS, file.name)
 		if err != nil {
 			log.Printf("%s not found\n", file.name)
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
-		defer fp.Close()
 		w.Header().Add("Content-Type", file.kind)
-		http.ServeContent(w, r, file.name, file.mod, fp)
+		http.ServeContent(w, r, file.name, file.mod, bytes.NewReader(data))
 		return
 	}
 
@@ -240,8 +932,201 @@ func filetype(name string, data []byte) string {
 	return mtype.String()
 }
 
+// rewriteToCAS points attribute i of n at the content-addressed form of
+// rpath and adds a matching SRI integrity attribute, when rpath is a file
+// we know about.
+func (s *server) rewriteToCAS(n *html.Node, i int, rpath string) {
+	fi, ok := s.lookupFile(rpath)
+	if !ok {
+		return
+	}
+	n.Attr[i].Val = "/.cas/" + fi.cksum
+
+	integrity := "sha256-" + base64.StdEncoding.EncodeToString(fi.sum256)
+	for j := range n.Attr {
+		if n.Attr[j].Key == "integrity" {
+			n.Attr[j].Val = integrity
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "integrity", Val: integrity})
+}
+
+// Rewriter rewrites an attribute's raw value (e.g. an href or src), either
+// into a site-relative URL or into an intermediate form (e.g. the absolute
+// URL waybackRewriter unwraps) for another rewriter to finish. tag and attr identify where val came from (e.g. "img",
+// "src"), letting a Rewriter limit itself to particular elements if it
+// needs to. Implementations report whether they changed val at all so
+// rewriteURL can chain several of them and know whether any applied.
+type Rewriter interface {
+	Rewrite(tag, attr, val string) (string, bool)
+}
+
+// prefixRewriter strips a known host prefix, turning an absolute URL like
+// "https://playbymail.net/foo/bar.html" into the site-relative
+// "/foo/bar.html". This is the prefix stripping that clean used to do
+// inline for every attribute, now just the default member of s.rewriters.
+type prefixRewriter struct {
+	prefixes []string
+}
+
+func (p prefixRewriter) Rewrite(tag, attr, val string) (string, bool) {
+	for _, pfx := range p.prefixes {
+		if strings.HasPrefix(val, pfx) {
+			return "/" + strings.TrimPrefix(val, pfx), true
+		}
+	}
+	return val, false
+}
+
+// waybackURLPattern matches a Wayback Machine replay URL and captures the
+// original URL it wraps, e.g.
+// "https://web.archive.org/web/20210102030405/https://example.com/foo".
+var waybackURLPattern = regexp.MustCompile(`^https?://web\.archive\.org/web/\d+(?:[a-z_]*)/(https?://.*)$`)
+
+// waybackRewriter unwraps a Wayback Machine replay URL to the original URL
+// it archived, so a raw WARC/replay dump can be fed straight into the other
+// rewriters (e.g. prefixRewriter) instead of being served as-is.
+type waybackRewriter struct{}
+
+func (waybackRewriter) Rewrite(tag, attr, val string) (string, bool) {
+	m := waybackURLPattern.FindStringSubmatch(val)
+	if m == nil {
+		return val, false
+	}
+	return m[1], true
+}
+
+// regexRule is one rewrite rule in a -rewriters JSON config file.
+type regexRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// regexRewriter applies a user-supplied list of regexp->replacement rules,
+// loaded from a -rewriters JSON config. This is the escape hatch for
+// archives whose link shape prefixRewriter and waybackRewriter don't cover.
+type regexRewriter struct {
+	rules []*regexp.Regexp
+	repls []string
+}
+
+func (r regexRewriter) Rewrite(tag, attr, val string) (string, bool) {
+	matched := false
+	for i, re := range r.rules {
+		if re.MatchString(val) {
+			val = re.ReplaceAllString(val, r.repls[i])
+			matched = true
+		}
+	}
+	return val, matched
+}
+
+// loadRewriters reads a JSON array of regexRule from path and returns the
+// corresponding regexRewriter, compiled and ready to register in
+// s.rewriters.
+func loadRewriters(p string) (Rewriter, error) {
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var rules []regexRule
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	rr := regexRewriter{rules: make([]*regexp.Regexp, len(rules)), repls: make([]string, len(rules))}
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q: %v", p, rule.Pattern, err)
+		}
+		rr.rules[i], rr.repls[i] = re, rule.Replacement
+	}
+	return rr, nil
+}
+
+// rewriteURL runs raw through every rewriter in s.rewriters in turn,
+// feeding each one's output to the next, and returns the final site-
+// relative form (e.g. "/foo/bar.html") along with the bare relative path
+// (e.g. "foo/bar.html", suitable for a s.files lookup) and whether any
+// rewriter matched at all. If none did, raw is returned unchanged.
+func (s *server) rewriteURL(tag, attr, raw string) (val string, rpath string, matched bool) {
+	val = raw
+	// Run the chain to a fixed point rather than a single pass: one
+	// rewriter's output (e.g. waybackRewriter unwrapping a replay URL back
+	// to an absolute playbymail.net URL) is often exactly what an earlier
+	// rewriter in the list (e.g. prefixRewriter) needs to see to do its
+	// job, regardless of registration order. Bounded by len(s.rewriters)
+	// passes so a pair of rewriters that keep undoing each other can't
+	// loop forever.
+	for pass := 0; pass < len(s.rewriters); pass++ {
+		changed := false
+		for _, rw := range s.rewriters {
+			if v, ok := rw.Rewrite(tag, attr, val); ok {
+				val = v
+				matched = true
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	if !matched {
+		return raw, "", false
+	}
+	return val, strings.TrimPrefix(val, "/"), true
+}
+
+// cssURLPattern matches a CSS url(...) function, capturing the optional
+// surrounding quote and the URL itself. RE2 has no backreferences, so the
+// closing quote is captured separately (group 3) and ignored rather than
+// matched against group 1.
+var cssURLPattern = regexp.MustCompile(`url\(\s*(['"]?)([^'")]*)(['"]?)\s*\)`)
+
+// rewriteCSSURLs rewrites every url(...) reference in a chunk of CSS text,
+// whether that's a <style> body (tag "style", attr "") or an inline
+// style="..." attribute value (attr "style").
+func (s *server) rewriteCSSURLs(tag, attr, css string) string {
+	return cssURLPattern.ReplaceAllStringFunc(css, func(match string) string {
+		sub := cssURLPattern.FindStringSubmatch(match)
+		quote, raw := sub[1], sub[2]
+		if val, _, ok := s.rewriteURL(tag, attr, raw); ok {
+			return "url(" + quote + val + quote + ")"
+		}
+		return match
+	})
+}
+
+// rewriteMetaRefresh rewrites the url=... portion of a
+// <meta http-equiv="refresh" content="5; url=..."> value.
+func (s *server) rewriteMetaRefresh(content string) string {
+	delay, rest, ok := strings.Cut(content, ";")
+	if !ok {
+		return content
+	}
+	rest = strings.TrimSpace(rest)
+	raw, ok := strings.CutPrefix(rest, "url=")
+	if !ok {
+		raw, ok = strings.CutPrefix(rest, "URL=")
+	}
+	if !ok {
+		return content
+	}
+	quote := ""
+	if len(raw) > 0 && (raw[0] == '\'' || raw[0] == '"') {
+		quote = raw[:1]
+		raw = strings.TrimSuffix(strings.TrimPrefix(raw, quote), quote)
+	}
+	val, _, matched := s.rewriteURL("meta", "content", raw)
+	if !matched {
+		return content
+	}
+	return delay + "; url=" + quote + val + quote
+}
+
 func (s *server) clean(name string) (io.ReadSeeker, error) {
-	fp, err := os.Open(name)
+	fp, err := s.publicFS.Open(name)
 	if err != nil {
 		return nil, err
 	}
@@ -253,36 +1138,37 @@ func (s *server) clean(name string) (io.ReadSeeker, error) {
 	}
 	var f func(*html.Node)
 	f = func(n *html.Node) {
-		if n.Type == html.ElementNode {
+		if n.Type == html.TextNode && n.Parent != nil && n.Parent.Data == "style" {
+			n.Data = s.rewriteCSSURLs("style", "", n.Data)
+		} else if n.Type == html.ElementNode {
+			for i := range n.Attr {
+				if n.Attr[i].Key == "style" {
+					n.Attr[i].Val = s.rewriteCSSURLs(n.Data, "style", n.Attr[i].Val)
+				}
+			}
 			if n.Data == "a" {
 				for i := range n.Attr {
 					if n.Attr[i].Key == "href" {
-						for _, pfx := range s.pfx {
-							if strings.HasPrefix(n.Attr[i].Val, pfx) {
-								n.Attr[i].Val = "/" + strings.TrimPrefix(n.Attr[i].Val, pfx)
-								break
-							}
+						if val, _, ok := s.rewriteURL(n.Data, "href", n.Attr[i].Val); ok {
+							n.Attr[i].Val = val
 						}
 					}
 				}
-			} else if n.Data == "img" {
+			} else if n.Data == "img" || n.Data == "source" {
 				for i := range n.Attr {
 					if n.Attr[i].Key == "src" {
-						for _, pfx := range s.pfx {
-							if strings.HasPrefix(n.Attr[i].Val, pfx) {
-								n.Attr[i].Val = "/" + strings.TrimPrefix(n.Attr[i].Val, pfx)
-								break
+						if val, rpath, ok := s.rewriteURL(n.Data, "src", n.Attr[i].Val); ok {
+							n.Attr[i].Val = val
+							if s.cas && n.Data == "img" {
+								s.rewriteToCAS(n, i, rpath)
 							}
 						}
 					} else if n.Attr[i].Key == "srcset" {
 						sources := strings.Split(n.Attr[i].Val, ",")
 						var alt []string
 						for _, source := range sources {
-							for _, pfx := range s.pfx {
-								if strings.HasPrefix(source, pfx) {
-									source = "/" + strings.TrimPrefix(source, pfx)
-									break
-								}
+							if val, _, ok := s.rewriteURL(n.Data, "srcset", source); ok {
+								source = val
 							}
 							alt = append(alt, source)
 						}
@@ -290,12 +1176,18 @@ func (s *server) clean(name string) (io.ReadSeeker, error) {
 					}
 				}
 			} else if n.Data == "link" {
+				stylesheet := false
+				for _, a := range n.Attr {
+					if a.Key == "rel" && a.Val == "stylesheet" {
+						stylesheet = true
+					}
+				}
 				for i := range n.Attr {
 					if n.Attr[i].Key == "href" {
-						for _, pfx := range s.pfx {
-							if strings.HasPrefix(n.Attr[i].Val, pfx) {
-								n.Attr[i].Val = "/" + strings.TrimPrefix(n.Attr[i].Val, pfx)
-								break
+						if val, rpath, ok := s.rewriteURL(n.Data, "href", n.Attr[i].Val); ok {
+							n.Attr[i].Val = val
+							if s.cas && stylesheet {
+								s.rewriteToCAS(n, i, rpath)
 							}
 						}
 					}
@@ -303,14 +1195,52 @@ func (s *server) clean(name string) (io.ReadSeeker, error) {
 			} else if n.Data == "script" {
 				for i := range n.Attr {
 					if n.Attr[i].Key == "src" {
-						for _, pfx := range s.pfx {
-							if strings.HasPrefix(n.Attr[i].Val, pfx) {
-								n.Attr[i].Val = "/" + strings.TrimPrefix(n.Attr[i].Val, pfx)
-								break
+						if val, rpath, ok := s.rewriteURL(n.Data, "src", n.Attr[i].Val); ok {
+							n.Attr[i].Val = val
+							if s.cas {
+								s.rewriteToCAS(n, i, rpath)
 							}
 						}
 					}
 				}
+			} else if n.Data == "iframe" {
+				for i := range n.Attr {
+					if n.Attr[i].Key == "src" {
+						if val, _, ok := s.rewriteURL(n.Data, "src", n.Attr[i].Val); ok {
+							n.Attr[i].Val = val
+						}
+					}
+				}
+			} else if n.Data == "form" {
+				for i := range n.Attr {
+					if n.Attr[i].Key == "action" {
+						if val, _, ok := s.rewriteURL(n.Data, "action", n.Attr[i].Val); ok {
+							n.Attr[i].Val = val
+						}
+					}
+				}
+			} else if n.Data == "base" {
+				for i := range n.Attr {
+					if n.Attr[i].Key == "href" {
+						if val, _, ok := s.rewriteURL(n.Data, "href", n.Attr[i].Val); ok {
+							n.Attr[i].Val = val
+						}
+					}
+				}
+			} else if n.Data == "meta" {
+				refresh := false
+				for _, a := range n.Attr {
+					if a.Key == "http-equiv" && strings.EqualFold(a.Val, "refresh") {
+						refresh = true
+					}
+				}
+				if refresh {
+					for i := range n.Attr {
+						if n.Attr[i].Key == "content" {
+							n.Attr[i].Val = s.rewriteMetaRefresh(n.Attr[i].Val)
+						}
+					}
+				}
 			}
 		}
 		for c := n.FirstChild; c != nil; c = c.NextSibling {